@@ -1,14 +1,21 @@
 package testserver
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 /*
@@ -27,8 +34,13 @@ Test cases:
   8.1. Query string
   8.2. POST form param
 9. Req headers
+10. ReqBodyMatchesRegex
+11. ReqBodyMatchesJSONPath
+12. ReqHeaderMatches
+13. ReqQueryParamMatches
+14. ReqMatcher
 
-10. ALL IN ONE
+15. ALL IN ONE
 
 */
 
@@ -365,6 +377,143 @@ func TestTestServer(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "ReqBodyMatchesRegex",
+			mockFn: func() *TestServer {
+				ts := New(t)
+
+				ts.Add(EXPECT().Method("POST").Path("/sample").
+					ReqBodyMatchesRegex(`^order-\d+$`).
+					RespWithStatus(200),
+				)
+				ts.Start()
+
+				return ts
+			},
+			testFn: func(host string) (*http.Response, error) {
+				body := bytes.NewBufferString("order-1337")
+
+				return http.Post(host+"/sample", "text/plain", body)
+			},
+			want: want{
+				statusCode: 200,
+				respBody:   nil,
+				respHeader: http.Header{
+					"Content-Length": {"0"},
+				},
+			},
+		},
+		{
+			name: "ReqBodyMatchesJSONPath",
+			mockFn: func() *TestServer {
+				ts := New(t)
+
+				ts.Add(EXPECT().Method("POST").Path("/sample").
+					ReqBodyMatchesJSONPath("user.id", "1000000").
+					RespWithStatus(200),
+				)
+				ts.Start()
+
+				return ts
+			},
+			testFn: func(host string) (*http.Response, error) {
+				body := bytes.NewBufferString(`{"user":{"id":1000000}}`)
+
+				return http.Post(host+"/sample", "application/json", body)
+			},
+			want: want{
+				statusCode: 200,
+				respBody:   nil,
+				respHeader: http.Header{
+					"Content-Length": {"0"},
+				},
+			},
+		},
+		{
+			name: "ReqHeaderMatches",
+			mockFn: func() *TestServer {
+				ts := New(t)
+
+				ts.Add(EXPECT().Method("GET").Path("/sample").
+					ReqHeaderMatches("Authorization", `^Bearer \S+$`).
+					RespWithStatus(200),
+				)
+				ts.Start()
+
+				return ts
+			},
+			testFn: func(host string) (*http.Response, error) {
+				uri, _ := url.Parse(host + "/sample")
+				req := http.Request{
+					Method: "GET",
+					URL:    uri,
+					Header: map[string][]string{
+						"Authorization": {"Bearer abc123"},
+					}}
+
+				return http.DefaultClient.Do(&req)
+			},
+			want: want{
+				statusCode: 200,
+				respBody:   nil,
+				respHeader: http.Header{
+					"Content-Length": {"0"},
+				},
+			},
+		},
+		{
+			name: "ReqQueryParamMatches",
+			mockFn: func() *TestServer {
+				ts := New(t)
+
+				ts.Add(EXPECT().Method("GET").Path("/api/v1/clients").
+					ReqQueryParamMatches("page", `^\d+$`).
+					RespWithStatus(200),
+				)
+				ts.Start()
+
+				return ts
+			},
+			testFn: func(host string) (*http.Response, error) {
+				return http.Get(host + "/api/v1/clients?page=3")
+			},
+			want: want{
+				statusCode: 200,
+				respBody:   nil,
+				respHeader: http.Header{
+					"Content-Length": {"0"},
+				},
+			},
+		},
+		{
+			name: "ReqMatcher",
+			mockFn: func() *TestServer {
+				ts := New(t)
+
+				ts.Add(EXPECT().Method("GET").Path("/sample").
+					ReqMatcher(func(r *http.Request) error {
+						if r.ContentLength > 0 {
+							return fmt.Errorf("expected no body, got Content-Length %d", r.ContentLength)
+						}
+						return nil
+					}).
+					RespWithStatus(200),
+				)
+				ts.Start()
+
+				return ts
+			},
+			testFn: func(host string) (*http.Response, error) {
+				return http.Get(host + "/sample")
+			},
+			want: want{
+				statusCode: 200,
+				respBody:   nil,
+				respHeader: http.Header{
+					"Content-Length": {"0"},
+				},
+			},
+		},
 		{
 			name: "ALL IN",
 			mockFn: func() *TestServer {
@@ -397,16 +546,16 @@ func TestTestServer(t *testing.T) {
 			},
 			testFn: func(host string) (*http.Response, error) {
 				uri1, _ := url.Parse(host + "/1")
-				req1 := http.Request{
-					Method: "POST",
-					URL:    uri1,
-					Header: map[string][]string{
-						"Header-1": {"value-1"},
-					},
-					Body: io.NopCloser(bytes.NewBufferString("1")),
-				}
 
 				for i := 0; i < 3; i++ {
+					req1 := http.Request{
+						Method: "POST",
+						URL:    uri1,
+						Header: map[string][]string{
+							"Header-1": {"value-1"},
+						},
+						Body: io.NopCloser(bytes.NewBufferString("1")),
+					}
 					_, err := http.DefaultClient.Do(&req1)
 					if err != nil {
 						t.Errorf("fail")
@@ -471,3 +620,360 @@ func TestTestServer(t *testing.T) {
 		})
 	}
 }
+
+// TestConcurrentCallTracking fires a burst of concurrent requests at the
+// same expectation and checks that CallsFor sees every one of them (no
+// dropped counts from an unguarded counter), that LastRequest reflects a
+// real captured call, and that WaitForCalls unblocks once the target count
+// is reached.
+func TestConcurrentCallTracking(t *testing.T) {
+	const n = 50
+
+	ts := New(t)
+	ts.Add(EXPECT().Method("GET").Path("/burst").
+		RespWithStatus(200).
+		Times(n),
+	)
+	ts.Start()
+	defer ts.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(ts.URL + "/burst")
+			if err != nil {
+				t.Errorf("test failed: %v", err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	if err := ts.WaitForCalls("GET", "/burst", n, time.Second); err != nil {
+		t.Errorf("WaitForCalls failed: %v", err)
+	}
+	if got := ts.CallsFor("GET", "/burst"); got != n {
+		t.Errorf("CallsFor doesn't match expectation\nGot: %d\nWant: %d\n", got, n)
+	}
+	if last := ts.LastRequest("GET", "/burst"); last == nil {
+		t.Errorf("LastRequest returned nil, want a recorded call")
+	}
+}
+
+// TestLoadOpenAPI loads a spec documenting two operations, checks that
+// listPets is served from its auto-registered spec example, that an
+// explicit expectation bound to createPet via MatchesOperation takes
+// priority over createPet's auto-registered spec example, and that the
+// auto-registered expectation left unused doesn't force a call before
+// Stop() will pass.
+func TestLoadOpenAPI(t *testing.T) {
+	spec := `{
+		"paths": {
+			"/pets": {
+				"get": {
+					"operationId": "listPets",
+					"responses": {
+						"200": {
+							"content": {
+								"application/json": {
+									"example": [{"id": 1, "name": "Rex"}],
+									"schema": {
+										"type": "array",
+										"items": {
+											"type": "object",
+											"properties": {
+												"id": {"type": "integer"},
+												"name": {"type": "string"}
+											}
+										}
+									}
+								}
+							}
+						}
+					}
+				}
+			},
+			"/pets/new": {
+				"post": {
+					"operationId": "createPet",
+					"requestBody": {
+						"content": {
+							"application/json": {
+								"schema": {
+									"type": "object",
+									"required": ["name"],
+									"properties": {
+										"name": {"type": "string"}
+									}
+								}
+							}
+						}
+					},
+					"responses": {
+						"201": {
+							"content": {
+								"application/json": {
+									"example": {"id": 2, "name": "Fido"}
+								}
+							}
+						}
+					}
+				}
+			}
+		}
+	}`
+
+	specPath := t.TempDir() + "/openapi.json"
+	if err := os.WriteFile(specPath, []byte(spec), 0o644); err != nil {
+		t.Fatalf("write spec: %v", err)
+	}
+
+	ts := New(t)
+	if err := ts.LoadOpenAPI(specPath); err != nil {
+		t.Fatalf("LoadOpenAPI failed: %v", err)
+	}
+	ts.Add(EXPECT().Method("POST").Path("/pets/new").
+		MatchesOperation("createPet").
+		RespWithStatus(201).
+		RespWithBody(testBody{Name: "Carl Cox"}),
+	)
+	ts.Start()
+	defer ts.Stop()
+
+	resp, err := http.Get(ts.URL + "/pets")
+	if err != nil {
+		t.Fatalf("test failed: %v", err)
+	}
+	gotBody, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	wantBody := `[{"id":1,"name":"Rex"}]`
+	if string(gotBody) != wantBody {
+		t.Errorf("body doesn't match expectation\nGot: %s\nWant: %s\n", gotBody, wantBody)
+	}
+
+	// createPet's own explicit expectation must win over the auto-registered
+	// spec example sharing the same path+method.
+	resp, err = http.Post(ts.URL+"/pets/new", "application/json", bytes.NewBufferString(`{"name":"Carl Cox"}`))
+	if err != nil {
+		t.Fatalf("test failed: %v", err)
+	}
+	gotBody, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != 201 {
+		t.Errorf("resp status doesn't match expectation\nGot: %d\nWant: %d\n", resp.StatusCode, 201)
+	}
+	wantCreateBody := `{"name":"Carl Cox","age":0}`
+	if string(gotBody) != wantCreateBody {
+		t.Errorf("body doesn't match expectation\nGot: %s\nWant: %s\n", gotBody, wantCreateBody)
+	}
+}
+
+// TestRecordAndReplay captures a call to a real upstream via RecordFrom/
+// RecordTo, then checks that Replay, reading the fixture back, serves the
+// exact same response without talking to the upstream again.
+func TestRecordAndReplay(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(`{"name":"Carl Cox"}`))
+	}))
+	defer upstream.Close()
+
+	fixturePath := t.TempDir() + "/recorded.go"
+
+	rec := New(t)
+	rec.RecordFrom(upstream.URL)
+	rec.RecordTo(fixturePath)
+	rec.Start()
+
+	resp, err := http.Get(rec.URL + "/profile")
+	if err != nil {
+		t.Fatalf("test failed: %v", err)
+	}
+	gotBody, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	rec.Stop()
+
+	wantBody := `{"name":"Carl Cox"}`
+	if string(gotBody) != wantBody {
+		t.Errorf("body doesn't match expectation\nGot: %s\nWant: %s\n", gotBody, wantBody)
+	}
+
+	replay := New(t)
+	if err := replay.Replay(fixturePath); err != nil {
+		t.Fatalf("replay failed: %v", err)
+	}
+	replay.Start()
+	defer replay.Stop()
+
+	resp, err = http.Get(replay.URL + "/profile")
+	if err != nil {
+		t.Fatalf("test failed: %v", err)
+	}
+	gotBody, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(gotBody) != wantBody {
+		t.Errorf("body doesn't match expectation\nGot: %s\nWant: %s\n", gotBody, wantBody)
+	}
+}
+
+// TestFaultInjection checks RespWithChunks streams each chunk separately,
+// RespWithHijackReset closes the connection before any response is
+// written (which the client observes as a transport error rather than a
+// status code), RespWithDelay actually makes the caller wait, and
+// RespWithCloseConnection closes the connection once the response has
+// been written, preventing it from being reused for a later request.
+func TestFaultInjection(t *testing.T) {
+	ts := New(t)
+
+	ts.Add(EXPECT().Method("GET").Path("/stream").
+		RespWithStatus(200).
+		RespWithChunks([][]byte{[]byte("chunk-1"), []byte("chunk-2")}, 0),
+	)
+	ts.Add(EXPECT().Method("POST").Path("/reset").
+		RespWithHijackReset(),
+	)
+	ts.Add(EXPECT().Method("GET").Path("/slow").
+		RespWithStatus(200).
+		RespWithDelay(150 * time.Millisecond),
+	)
+	ts.Add(EXPECT().Method("GET").Path("/closeconn").
+		RespWithStatus(200).
+		RespWithBody([]byte("bye")).
+		RespWithCloseConnection(),
+	)
+	ts.Start()
+	defer ts.Stop()
+
+	resp, err := http.Get(ts.URL + "/stream")
+	if err != nil {
+		t.Fatalf("test failed: %v", err)
+	}
+	gotBody, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	wantBody := "chunk-1chunk-2"
+	if string(gotBody) != wantBody {
+		t.Errorf("body doesn't match expectation\nGot: %s\nWant: %s\n", gotBody, wantBody)
+	}
+
+	// POST is not safe to retry, so a reset connection surfaces to the
+	// client as an error instead of being silently retried.
+	if _, err := http.Post(ts.URL+"/reset", "text/plain", nil); err == nil {
+		t.Errorf("expected a connection error from RespWithHijackReset, got nil")
+	}
+
+	start := time.Now()
+	resp, err = http.Get(ts.URL + "/slow")
+	if err != nil {
+		t.Fatalf("test failed: %v", err)
+	}
+	resp.Body.Close()
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("RespWithDelay didn't delay the response\nGot: %s\nWant at least: %s\n", elapsed, 150*time.Millisecond)
+	}
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("GET /closeconn HTTP/1.1\r\nHost: " + ts.Listener.Addr().String() + "\r\n\r\n")); err != nil {
+		t.Fatalf("write request failed: %v", err)
+	}
+	bufr := bufio.NewReader(conn)
+	closeResp, err := http.ReadResponse(bufr, nil)
+	if err != nil {
+		t.Fatalf("read response failed: %v", err)
+	}
+	gotBody, _ = io.ReadAll(closeResp.Body)
+	closeResp.Body.Close()
+	if string(gotBody) != "bye" {
+		t.Errorf("body doesn't match expectation\nGot: %s\nWant: %s\n", gotBody, "bye")
+	}
+
+	// RespWithCloseConnection closes the underlying connection right after
+	// writing the response, so trying to read another response off the
+	// same connection must fail instead of hanging, waiting for reuse.
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := bufr.ReadByte(); err != io.EOF {
+		t.Errorf("expected EOF reading the reused connection after RespWithCloseConnection\nGot: %v\n", err)
+	}
+}
+
+// TestResponseTemplating checks that RespWithBodyTemplate and
+// RespWithHeaderTemplate render against the captured path param, query
+// param and request body, and that RespWithStatusFunc computes the status
+// from the request instead of a fixed value.
+func TestResponseTemplating(t *testing.T) {
+	ts := New(t)
+
+	ts.Add(EXPECT().Method("POST").Path("/echo/{id}").
+		RespWithStatusFunc(func(r *http.Request) int {
+			if r.URL.Query().Get("fail") == "true" {
+				return 400
+			}
+			return 201
+		}).
+		RespWithHeaderTemplate("X-Echo-Id", "{{.PathParams.id}}").
+		RespWithBodyTemplate(`{"id":"{{.PathParams.id}}","name":"{{.JSON.name}}"}`),
+	)
+	ts.Start()
+	defer ts.Stop()
+
+	resp, err := http.Post(ts.URL+"/echo/42", "application/json", bytes.NewBufferString(`{"name":"Carl"}`))
+	if err != nil {
+		t.Fatalf("test failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 201 {
+		t.Errorf("resp status doesn't match expectation\nGot: %d\nWant: %d\n", resp.StatusCode, 201)
+	}
+	if got := resp.Header.Get("X-Echo-Id"); got != "42" {
+		t.Errorf("header doesn't match expectation\nGot: %s\nWant: %s\n", got, "42")
+	}
+	gotBody, _ := io.ReadAll(resp.Body)
+	wantBody := `{"id":"42","name":"Carl"}`
+	if string(gotBody) != wantBody {
+		t.Errorf("body doesn't match expectation\nGot: %s\nWant: %s\n", gotBody, wantBody)
+	}
+}
+
+// TestScenario exercises a login -> logout flow where every call
+// hits the same URL+method but must return a different response in order,
+// driven entirely by Scenario/NewScenario state transitions.
+func TestScenario(t *testing.T) {
+	ts := New(t)
+	ts.NewScenario("session")
+
+	ts.Add(EXPECT().Method("POST").Path("/session").
+		Scenario("session", ScenarioStarted, "logged-in").
+		RespWithStatus(200).
+		RespWithBody([]byte("logged-in")),
+	)
+	ts.Add(EXPECT().Method("POST").Path("/session").
+		Scenario("session", "logged-in", "logged-out").
+		RespWithStatus(200).
+		RespWithBody([]byte("logged-out")),
+	)
+	ts.Start()
+	defer ts.Stop()
+
+	for _, want := range []string{"logged-in", "logged-out"} {
+		resp, err := http.Post(ts.URL+"/session", "text/plain", nil)
+		if err != nil {
+			t.Fatalf("test failed: %v", err)
+		}
+		gotBody, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(gotBody) != want {
+			t.Errorf("body doesn't match expectation\nGot: %s\nWant: %s\n", gotBody, want)
+		}
+	}
+}
@@ -6,27 +6,488 @@ import (
 	"fmt"
 	"github.com/gorilla/mux"
 	"io"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"text/template"
+	"time"
 )
 
+// matcher validates one aspect of an incoming request against an expectation.
+// It returns a human-readable failure message for every mismatch it finds, or
+// nil if the request satisfies it. Every Req* method on ExpectationBuilder
+// appends a matcher, and Add() runs them all, in the order they were added,
+// against each call routed to the testcase.
+type matcher interface {
+	match(method, path string, r *http.Request, body []byte) []string
+}
+
+type methodMatcher struct {
+	want string
+}
+
+func (m methodMatcher) match(method, path string, r *http.Request, body []byte) []string {
+	if method != m.want {
+		return []string{fmt.Sprintf("wrong request method\nGot: %s %s\nWant: %s %s\n",
+			method, path, m.want, path)}
+	}
+	return nil
+}
+
+type exactBodyMatcher struct {
+	want []byte
+}
+
+func (m exactBodyMatcher) match(method, path string, r *http.Request, body []byte) []string {
+	if bytes.Compare(body, m.want) != 0 {
+		return []string{fmt.Sprintf("%s %s expect different reqeust body\nGot: %s\nWant: %s\n",
+			method, path, body, m.want)}
+	}
+	return nil
+}
+
+type containsBodyMatcher struct {
+	want []byte
+}
+
+func (m containsBodyMatcher) match(method, path string, r *http.Request, body []byte) []string {
+	if !bytes.Contains(body, m.want) {
+		return []string{fmt.Sprintf("%s %s reqeust body doesnt contain expected value \nGot: %s\nWant contains: %s\n",
+			method, path, body, m.want)}
+	}
+	return nil
+}
+
+type regexBodyMatcher struct {
+	re *regexp.Regexp
+}
+
+func (m regexBodyMatcher) match(method, path string, r *http.Request, body []byte) []string {
+	if !m.re.Match(body) {
+		return []string{fmt.Sprintf("%s %s reqeust body doesnt match expected pattern \nGot: %s\nWant pattern: %s\n",
+			method, path, body, m.re.String())}
+	}
+	return nil
+}
+
+type jsonPathBodyMatcher struct {
+	path string
+	want string
+}
+
+func (m jsonPathBodyMatcher) match(method, path string, r *http.Request, body []byte) []string {
+	var data interface{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return []string{fmt.Sprintf("%s %s reqeust body is not valid json: %v\nGot: %s\n",
+			method, path, err, body)}
+	}
+	got, err := lookupJSONPath(data, m.path)
+	if err != nil {
+		return []string{fmt.Sprintf("%s %s json path %q: %v\nGot: %s\n",
+			method, path, m.path, err, body)}
+	}
+	if gotStr := jsonValueString(got); gotStr != m.want {
+		return []string{fmt.Sprintf("%s %s json path %q doesn't match expectation \nGot: %s\nWant: %s\n",
+			method, path, m.path, gotStr, m.want)}
+	}
+	return nil
+}
+
+// jsonValueString stringifies a value decoded from JSON the way a human
+// would expect, in particular formatting float64 (what encoding/json
+// decodes every JSON number into) without resorting to scientific
+// notation for large values.
+func jsonValueString(v interface{}) string {
+	if f, ok := v.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+type pathParamMatcher struct {
+	want map[string]string
+}
+
+func (m pathParamMatcher) match(method, path string, r *http.Request, body []byte) []string {
+	var fails []string
+	got := mux.Vars(r)
+	for wantK, wantV := range m.want {
+		if gotV, ok := got[wantK]; !ok {
+			fails = append(fails,
+				fmt.Sprintf("%s %s check your expectations: there is no %s path param", method, path, wantK))
+		} else if gotV != wantV {
+			fails = append(fails,
+				fmt.Sprintf("%s %s path param %q doesn't match expectation \nGot: %s\nWant: %s",
+					method, path, wantK, gotV, wantV))
+		}
+	}
+	return fails
+}
+
+type queryParamMatcher struct {
+	want map[string]string
+}
+
+func (m queryParamMatcher) match(method, path string, r *http.Request, body []byte) []string {
+	var fails []string
+	for wantK, wantV := range m.want {
+		if gotV := r.FormValue(wantK); gotV != wantV {
+			fails = append(fails,
+				fmt.Sprintf("%s %s query param %s doesn't match expectation \nGot: %s\nWant: %s",
+					method, path, wantK, gotV, wantV))
+		}
+	}
+	return fails
+}
+
+type queryParamRegexMatcher struct {
+	key string
+	re  *regexp.Regexp
+}
+
+func (m queryParamRegexMatcher) match(method, path string, r *http.Request, body []byte) []string {
+	got := r.FormValue(m.key)
+	if !m.re.MatchString(got) {
+		return []string{fmt.Sprintf("%s %s query param %s doesn't match expected pattern \nGot: %s\nWant pattern: %s",
+			method, path, m.key, got, m.re.String())}
+	}
+	return nil
+}
+
+type headerMatcher struct {
+	want http.Header
+}
+
+func (m headerMatcher) match(method, path string, r *http.Request, body []byte) []string {
+	var fails []string
+	for wantK, wantVV := range m.want {
+		if gotVV, ok := r.Header[wantK]; !ok {
+			fails = append(fails,
+				fmt.Sprintf("%s %s there is no %s request header", method, path, wantK))
+		} else {
+			for _, wantV := range wantVV {
+				if !contains(gotVV, wantV) {
+					fails = append(fails,
+						fmt.Sprintf("%s %s request header %q doesn't match expectation \nGot: %s\nWant: %s",
+							method, path, wantK, gotVV, wantV))
+				}
+			}
+		}
+	}
+	return fails
+}
+
+type headerRegexMatcher struct {
+	key string
+	re  *regexp.Regexp
+}
+
+func (m headerRegexMatcher) match(method, path string, r *http.Request, body []byte) []string {
+	gotVV, ok := r.Header[http.CanonicalHeaderKey(m.key)]
+	if !ok {
+		return []string{fmt.Sprintf("%s %s there is no %s request header", method, path, m.key)}
+	}
+	for _, gotV := range gotVV {
+		if m.re.MatchString(gotV) {
+			return nil
+		}
+	}
+	return []string{fmt.Sprintf("%s %s request header %q doesn't match expected pattern \nGot: %s\nWant pattern: %s",
+		method, path, m.key, gotVV, m.re.String())}
+}
+
+type predicateMatcher struct {
+	fn func(*http.Request) error
+}
+
+func (m predicateMatcher) match(method, path string, r *http.Request, body []byte) []string {
+	if err := m.fn(r); err != nil {
+		return []string{fmt.Sprintf("%s %s custom matcher failed: %v", method, path, err)}
+	}
+	return nil
+}
+
+// openAPISchema is a minimal subset of a JSON Schema / OpenAPI 3 schema
+// object: just enough to describe shapes commonly used in REST bodies.
+// It does not support formats, numeric bounds, enums, $ref, or
+// oneOf/allOf/anyOf.
+type openAPISchema struct {
+	Type       string                    `json:"type"`
+	Properties map[string]*openAPISchema `json:"properties"`
+	Items      *openAPISchema            `json:"items"`
+	Required   []string                  `json:"required"`
+}
+
+type openAPIMediaType struct {
+	Example interface{}    `json:"example"`
+	Schema  *openAPISchema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Content map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIResponse struct {
+	Content map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIOperation struct {
+	OperationID string                     `json:"operationId"`
+	RequestBody *openAPIRequestBody        `json:"requestBody"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+}
+
+type openAPISpec struct {
+	Paths map[string]map[string]openAPIOperation `json:"paths"`
+}
+
+// openAPIOperationSpec is what LoadOpenAPI keeps around per operationID so
+// MatchesOperation can bind an expectation to it.
+type openAPIOperationSpec struct {
+	method          string
+	path            string
+	requestSchema   *openAPISchema
+	responseSchemas map[int]*openAPISchema
+}
+
+// validateJSONSchema checks data against schema and returns one message per
+// violation found, or nil if it conforms.
+func validateJSONSchema(schema *openAPISchema, data interface{}) []string {
+	if schema == nil {
+		return nil
+	}
+
+	var fails []string
+	switch schema.Type {
+	case "object":
+		obj, ok := data.(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("expected object, got %T", data)}
+		}
+		for _, req := range schema.Required {
+			if _, ok := obj[req]; !ok {
+				fails = append(fails, fmt.Sprintf("missing required property %q", req))
+			}
+		}
+		for name, propSchema := range schema.Properties {
+			if v, ok := obj[name]; ok {
+				for _, f := range validateJSONSchema(propSchema, v) {
+					fails = append(fails, fmt.Sprintf("%s: %s", name, f))
+				}
+			}
+		}
+	case "array":
+		arr, ok := data.([]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("expected array, got %T", data)}
+		}
+		for i, item := range arr {
+			for _, f := range validateJSONSchema(schema.Items, item) {
+				fails = append(fails, fmt.Sprintf("[%d]: %s", i, f))
+			}
+		}
+	case "string":
+		if _, ok := data.(string); !ok {
+			fails = append(fails, fmt.Sprintf("expected string, got %T", data))
+		}
+	case "number":
+		if _, ok := data.(float64); !ok {
+			fails = append(fails, fmt.Sprintf("expected number, got %T", data))
+		}
+	case "integer":
+		if f, ok := data.(float64); !ok || f != math.Trunc(f) {
+			fails = append(fails, fmt.Sprintf("expected integer, got %v", data))
+		}
+	case "boolean":
+		if _, ok := data.(bool); !ok {
+			fails = append(fails, fmt.Sprintf("expected boolean, got %T", data))
+		}
+	}
+	return fails
+}
+
+// validateResponseSchema validates a response body against schema, prefixed
+// like the other match failure messages in this package.
+func validateResponseSchema(method, path string, schema *openAPISchema, body []byte) []string {
+	var data interface{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return []string{fmt.Sprintf("%s %s response body is not valid json: %v", method, path, err)}
+	}
+	var fails []string
+	for _, f := range validateJSONSchema(schema, data) {
+		fails = append(fails, fmt.Sprintf("%s %s response body schema violation: %s", method, path, f))
+	}
+	return fails
+}
+
+type schemaRequestMatcher struct {
+	schema *openAPISchema
+}
+
+func (m schemaRequestMatcher) match(method, path string, r *http.Request, body []byte) []string {
+	if len(body) == 0 {
+		return nil
+	}
+	var data interface{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return []string{fmt.Sprintf("%s %s request body is not valid json: %v", method, path, err)}
+	}
+	var fails []string
+	for _, f := range validateJSONSchema(m.schema, data) {
+		fails = append(fails, fmt.Sprintf("%s %s request body schema violation: %s", method, path, f))
+	}
+	return fails
+}
+
+func contains(s []string, e string) bool {
+	for _, a := range s {
+		if a == e {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupJSONPath resolves a small subset of JSONPath against a decoded JSON
+// value: dot-separated field names with optional [index] array accessors,
+// e.g. "user.id" or "items[0].name". A leading "$" is stripped if present.
+// It does not support wildcards, filters or recursive descent - just enough
+// to reach into a request body.
+func lookupJSONPath(data interface{}, path string) (interface{}, error) {
+	path = strings.TrimPrefix(path, "$")
+	path = strings.TrimPrefix(path, ".")
+
+	cur := data
+	for _, seg := range strings.Split(path, ".") {
+		if seg == "" {
+			continue
+		}
+
+		name := seg
+		var indices []int
+		for {
+			i := strings.IndexByte(name, '[')
+			if i == -1 {
+				break
+			}
+			j := strings.IndexByte(name, ']')
+			if j == -1 || j < i {
+				return nil, fmt.Errorf("malformed path segment %q", seg)
+			}
+			idx, err := strconv.Atoi(name[i+1 : j])
+			if err != nil {
+				return nil, fmt.Errorf("malformed array index in %q: %v", seg, err)
+			}
+			indices = append(indices, idx)
+			name = name[:i] + name[j+1:]
+		}
+
+		if name != "" {
+			m, ok := cur.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%q is not an object", name)
+			}
+			cur, ok = m[name]
+			if !ok {
+				return nil, fmt.Errorf("field %q not found", name)
+			}
+		}
+
+		for _, idx := range indices {
+			s, ok := cur.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%q is not an array", seg)
+			}
+			if idx < 0 || idx >= len(s) {
+				return nil, fmt.Errorf("index %d out of range in %q", idx, seg)
+			}
+			cur = s[idx]
+		}
+	}
+	return cur, nil
+}
+
 // ExpectationBuilder help to build expectations for http request and response
 type ExpectationBuilder struct {
-	method     string
 	urlPattern string
 
-	reqHeaders     http.Header
-	reqExactBody   []byte
-	reqContainBody []byte
+	matchers []matcher
+
 	reqPathParams  map[string]string
 	reqQueryParams map[string]string
+	reqHeaders     http.Header
 
-	respStatus  int
-	respHeaders http.Header
-	respBody    []byte
+	respStatus     int
+	respStatusFunc func(*http.Request) int
+	respHeaders    http.Header
+	respBody       []byte
+
+	respBodyTemplate    *template.Template
+	respHeaderTemplates []headerTemplate
+
+	respDelay       time.Duration
+	respChunks      [][]byte
+	respChunkGap    time.Duration
+	respCloseConn   bool
+	respHijackReset bool
 
 	times int
+
+	scenario     string
+	scenarioFrom string
+	scenarioTo   string
+
+	operationID       string
+	opResponseSchemas map[int]*openAPISchema
+
+	optional bool
+}
+
+// headerTemplate is a single RespWithHeaderTemplate call: a header key
+// paired with the template rendering its value.
+type headerTemplate struct {
+	key  string
+	tmpl *template.Template
+}
+
+// templateContext is the data exposed to RespWithBodyTemplate and
+// RespWithHeaderTemplate templates.
+type templateContext struct {
+	PathParams  map[string]string
+	QueryParams map[string]string
+	Headers     http.Header
+	Body        string
+	JSON        interface{}
+	Now         time.Time
+}
+
+func newTemplateContext(r *http.Request, body []byte) templateContext {
+	tctx := templateContext{
+		PathParams:  mux.Vars(r),
+		QueryParams: make(map[string]string, len(r.Form)),
+		Headers:     r.Header,
+		Body:        string(body),
+		Now:         time.Now(),
+	}
+	for k := range r.Form {
+		tctx.QueryParams[k] = r.Form.Get(k)
+	}
+	_ = json.Unmarshal(body, &tctx.JSON)
+	return tctx
+}
+
+func renderTemplate(t *template.Template, tctx templateContext) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, tctx); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
 // EXPECT initiate ExpectationBuilder object
@@ -44,7 +505,7 @@ func (eb *ExpectationBuilder) Times(t int) *ExpectationBuilder {
 
 // Method allows you to set method for Path
 func (eb *ExpectationBuilder) Method(method string) *ExpectationBuilder {
-	eb.method = method
+	eb.matchers = append(eb.matchers, methodMatcher{want: method})
 	return eb
 }
 
@@ -93,26 +554,108 @@ func (eb *ExpectationBuilder) RespWithBody(b interface{}) *ExpectationBuilder {
 	return eb
 }
 
+// RespWithBodyTemplate renders tmpl as a Go text/template for the response
+// body, once per matched call. The template is evaluated against a context
+// exposing .PathParams, .QueryParams, .Headers, .Body, .JSON (the request
+// body parsed as JSON, if any) and .Now, so a single expectation can echo
+// back a client-supplied ID, sign a nonce, or return a fresh timestamp.
+func (eb *ExpectationBuilder) RespWithBodyTemplate(tmpl string) *ExpectationBuilder {
+	t, err := template.New("respBody").Parse(tmpl)
+	if err != nil {
+		panic(err)
+	}
+	eb.respBodyTemplate = t
+	return eb
+}
+
+// RespWithHeaderTemplate allows you to set a response header whose value is
+// rendered from tmpl, using the same template context as
+// RespWithBodyTemplate. It can be called multiple times, including for the
+// same key.
+func (eb *ExpectationBuilder) RespWithHeaderTemplate(k, tmpl string) *ExpectationBuilder {
+	t, err := template.New("respHeader:" + k).Parse(tmpl)
+	if err != nil {
+		panic(err)
+	}
+	eb.respHeaderTemplates = append(eb.respHeaderTemplates, headerTemplate{key: k, tmpl: t})
+	return eb
+}
+
+// RespWithStatusFunc computes the response status from the incoming request
+// instead of the fixed value set via RespWithStatus.
+func (eb *ExpectationBuilder) RespWithStatusFunc(fn func(*http.Request) int) *ExpectationBuilder {
+	eb.respStatusFunc = fn
+	return eb
+}
+
+// RespWithDelay makes the server sleep for d before writing anything, to
+// simulate a slow upstream and exercise client-side timeouts.
+func (eb *ExpectationBuilder) RespWithDelay(d time.Duration) *ExpectationBuilder {
+	eb.respDelay = d
+	return eb
+}
+
+// RespWithChunks streams chunks one at a time, flushing after each and
+// sleeping gap in between, instead of writing RespWithBody in one shot.
+// Useful for simulating SSE/NDJSON style streaming responses.
+func (eb *ExpectationBuilder) RespWithChunks(chunks [][]byte, gap time.Duration) *ExpectationBuilder {
+	eb.respChunks = chunks
+	eb.respChunkGap = gap
+	return eb
+}
+
+// RespWithCloseConnection writes whatever response this expectation would
+// otherwise send, then closes the underlying connection instead of letting
+// it complete normally, simulating a premature EOF.
+func (eb *ExpectationBuilder) RespWithCloseConnection() *ExpectationBuilder {
+	eb.respCloseConn = true
+	return eb
+}
+
+// RespWithHijackReset hijacks the connection and closes it immediately,
+// without writing a status line or any response at all, simulating an
+// abrupt TCP reset.
+func (eb *ExpectationBuilder) RespWithHijackReset() *ExpectationBuilder {
+	eb.respHijackReset = true
+	return eb
+}
+
 // ReqBody allows you to set the request body to which the actual
 // request body should correspond exactly. You can use 2 time of args:
 //  1. []byte type allow to set byte slice that will return to the response body
 //  2. An any object that can be marshall to json
 func (eb *ExpectationBuilder) ReqBody(b interface{}) *ExpectationBuilder {
 	if body, ok := b.([]byte); ok {
-		eb.respBody = body
+		eb.matchers = append(eb.matchers, exactBodyMatcher{want: body})
 		return eb
 	}
 	if body, err := json.Marshal(b); err != nil {
 		panic(err)
 	} else {
-		eb.reqExactBody = body
+		eb.matchers = append(eb.matchers, exactBodyMatcher{want: body})
 	}
 	return eb
 }
 
 // ReqBodyContains allows you to specify the string that should be found in the request body
 func (eb *ExpectationBuilder) ReqBodyContains(s string) *ExpectationBuilder {
-	eb.reqContainBody = []byte(s)
+	eb.matchers = append(eb.matchers, containsBodyMatcher{want: []byte(s)})
+	return eb
+}
+
+// ReqBodyMatchesRegex allows you to specify a regular expression that the
+// request body must match, for fuzzy content such as generated IDs or
+// signed timestamps that can't be pinned down with ReqBody.
+func (eb *ExpectationBuilder) ReqBodyMatchesRegex(pattern string) *ExpectationBuilder {
+	eb.matchers = append(eb.matchers, regexBodyMatcher{re: regexp.MustCompile(pattern)})
+	return eb
+}
+
+// ReqBodyMatchesJSONPath allows you to specify that a JSON field reached by
+// path (e.g. "user.id" or "items[0].name") must stringify to value, without
+// having to pin down the rest of the body.
+func (eb *ExpectationBuilder) ReqBodyMatchesJSONPath(path, value string) *ExpectationBuilder {
+	eb.matchers = append(eb.matchers, jsonPathBodyMatcher{path: path, want: value})
 	return eb
 }
 
@@ -131,6 +674,7 @@ func (eb *ExpectationBuilder) ReqBodyContains(s string) *ExpectationBuilder {
 func (eb *ExpectationBuilder) ReqPathParam(k, v string) *ExpectationBuilder {
 	if eb.reqPathParams == nil {
 		eb.reqPathParams = make(map[string]string)
+		eb.matchers = append(eb.matchers, pathParamMatcher{want: eb.reqPathParams})
 	}
 	eb.reqPathParams[k] = v
 	return eb
@@ -142,21 +686,71 @@ func (eb *ExpectationBuilder) ReqPathParam(k, v string) *ExpectationBuilder {
 func (eb *ExpectationBuilder) ReqQueryParam(k, v string) *ExpectationBuilder {
 	if eb.reqQueryParams == nil {
 		eb.reqQueryParams = make(map[string]string)
+		eb.matchers = append(eb.matchers, queryParamMatcher{want: eb.reqQueryParams})
 	}
 	eb.reqQueryParams[k] = v
 	return eb
 }
 
+// ReqQueryParamMatches allows you to specify a regular expression that a
+// query string or form param must match.
+func (eb *ExpectationBuilder) ReqQueryParamMatches(k, pattern string) *ExpectationBuilder {
+	eb.matchers = append(eb.matchers, queryParamRegexMatcher{key: k, re: regexp.MustCompile(pattern)})
+	return eb
+}
+
 // ReqHeader allows you to set request headers expectation in key value format
 // it can be called multiple times.
 func (eb *ExpectationBuilder) ReqHeader(k, v string) *ExpectationBuilder {
 	if eb.reqHeaders == nil {
 		eb.reqHeaders = make(http.Header)
+		eb.matchers = append(eb.matchers, headerMatcher{want: eb.reqHeaders})
 	}
 	eb.reqHeaders[k] = append(eb.reqHeaders[k], v)
 	return eb
 }
 
+// ReqHeaderMatches allows you to specify a regular expression that at least
+// one value of the given request header must match.
+func (eb *ExpectationBuilder) ReqHeaderMatches(k, pattern string) *ExpectationBuilder {
+	eb.matchers = append(eb.matchers, headerRegexMatcher{key: k, re: regexp.MustCompile(pattern)})
+	return eb
+}
+
+// ReqMatcher allows you to plug in an arbitrary predicate over the incoming
+// *http.Request. Return a non-nil error to fail the expectation; the error
+// text is reported alongside the other match failures.
+func (eb *ExpectationBuilder) ReqMatcher(fn func(*http.Request) error) *ExpectationBuilder {
+	eb.matchers = append(eb.matchers, predicateMatcher{fn: fn})
+	return eb
+}
+
+// Scenario binds this expectation to a named, stateful sequence: it only
+// matches while scenario name is in fromState, and matching advances it to
+// toState. Combined with TestServer.NewScenario this lets you test
+// multi-step flows where the same URL+method must return different
+// responses in order, e.g. login -> fetch -> logout, or retry-then-succeed.
+func (eb *ExpectationBuilder) Scenario(name, fromState, toState string) *ExpectationBuilder {
+	eb.scenario = name
+	eb.scenarioFrom = fromState
+	eb.scenarioTo = toState
+	return eb
+}
+
+// MatchesOperation binds this expectation to operationID from a spec loaded
+// via TestServer.LoadOpenAPI: Add validates incoming requests against that
+// operation's request schema, and the eventual response against whichever
+// status code's schema matches, reporting violations the same way as any
+// other matcher.
+func (eb *ExpectationBuilder) MatchesOperation(operationID string) *ExpectationBuilder {
+	eb.operationID = operationID
+	return eb
+}
+
+// ScenarioStarted is the initial state of every scenario, including ones
+// used by an expectation without a prior call to NewScenario.
+const ScenarioStarted = "STARTED"
+
 /*
 TestServer is a structure that contains a set of expectations and a server from the httptest package.
 You should use a new instance of the test server in each test.
@@ -193,105 +787,338 @@ The algorithm for using the test server is as follows:
 type TestServer struct {
 	t *testing.T
 	*httptest.Server
-	cases map[string]*testcase
+	cases     map[string]*testcase
+	scenarios map[string]string
+
+	recordUpstream string
+	recordToPath   string
+	recorded       []recordedFixture
+
+	openapiOps map[string]*openAPIOperationSpec
+
+	mu    sync.Mutex
+	calls []RecordedRequest
+}
+
+// RecordedRequest is a snapshot of one handled call, taken before its
+// expectation's handler runs. It lets tests assert on calls after Stop()
+// instead of relying solely on inline matchers.
+type RecordedRequest struct {
+	Method  string
+	URL     string
+	Headers http.Header
+	Body    []byte
+
+	path string
+}
+
+// recordedFixture captures one request/response pair observed while
+// RecordFrom is active, enough to regenerate an expectation for it.
+type recordedFixture struct {
+	Method      string            `json:"method"`
+	Path        string            `json:"path"`
+	ReqBody     string            `json:"reqBody,omitempty"`
+	RespStatus  int               `json:"respStatus"`
+	RespBody    string            `json:"respBody,omitempty"`
+	RespHeaders map[string]string `json:"respHeaders,omitempty"`
 }
 
 type testcase struct {
-	n map[int]http.HandlerFunc
+	mu sync.Mutex
+
+	slots []*expectationSlot
 
 	wantedCalls int
 	actualCalls int
 	fails       []string
 }
 
-func (tc *testcase) checkMethod(path, want, got string) {
-	if got != want {
-		tc.fails = append(tc.fails,
-			fmt.Sprintf("wrong request method\nGot: %s %s\nWant: %s %s\n",
-				got, path, want, path))
+// addFail appends a single failure message, safe for concurrent calls.
+func (tc *testcase) addFail(fail string) {
+	tc.mu.Lock()
+	tc.fails = append(tc.fails, fail)
+	tc.mu.Unlock()
+}
+
+// addFails appends zero or more failure messages, safe for concurrent calls.
+func (tc *testcase) addFails(fails []string) {
+	if len(fails) == 0 {
+		return
 	}
+	tc.mu.Lock()
+	tc.fails = append(tc.fails, fails...)
+	tc.mu.Unlock()
 }
 
-func (tc *testcase) checkBody(method, path string, want, got []byte) {
-	if want != nil {
-		if bytes.Compare(got, want) != 0 {
-			tc.fails = append(tc.fails,
-				fmt.Sprintf("%s %s expect different reqeust body\nGot: %s\nWant: %s\n",
-					method, path, got, want))
-		}
+// expectationSlot is one use of an expectation added via Add: Times(3)
+// expands into 3 slots. A slot is eligible once, in order, unless it's
+// bound to a scenario, in which case it's only eligible while that
+// scenario is in fromState.
+type expectationSlot struct {
+	handler http.HandlerFunc
+	used    bool
+
+	hasScenario bool
+	scenario    string
+	fromState   string
+	toState     string
+
+	// optional slots can still be matched and served, but they don't count
+	// toward testcase.wantedCalls: LoadOpenAPI auto-registers one of these
+	// per documented operation, and a test exercising only a handful of
+	// endpoints from a large spec shouldn't have to call every one of them
+	// for Stop() to pass.
+	optional bool
+}
+
+// New create new instance of TestServer
+func New(t *testing.T) *TestServer {
+	return &TestServer{
+		t:     t,
+		cases: make(map[string]*testcase),
 	}
 }
 
-func (tc *testcase) checkBodyContains(method, path string, want, got []byte) {
-	if want != nil {
-		if !bytes.Contains(got, want) {
-			tc.fails = append(tc.fails,
-				fmt.Sprintf("%s %s reqeust body doesnt contain expected value \nGot: %s\nWant contains: %s\n",
-					method, path, got, want))
-		}
+// NewScenario registers a named scenario in its initial state. Expectations
+// bound to it via ExpectationBuilder.Scenario only match once the scenario
+// has reached the right state, and matching advances it to the next one.
+// Calling NewScenario is optional: a scenario referenced by an expectation
+// without one starts out ScenarioStarted anyway.
+func (ts *TestServer) NewScenario(name string) *TestServer {
+	if ts.scenarios == nil {
+		ts.scenarios = make(map[string]string)
 	}
+	ts.scenarios[name] = ScenarioStarted
+	return ts
 }
 
-func (tc *testcase) checkPathParams(method, path string, want, got map[string]string) {
-	if want != nil {
-		for wantK, wantV := range want {
-			if gotV, ok := got[wantK]; !ok {
-				tc.fails = append(tc.fails,
-					fmt.Sprintf("%s %s check your expectations: there is no %s path param", method, path, wantK))
-			} else if gotV != wantV {
-				tc.fails = append(tc.fails,
-					fmt.Sprintf("%s %s path param %q doesn't match expectation \nGot: %s\nWant: %s",
-						method, path, wantK, gotV, wantV))
-			}
-		}
+func (ts *TestServer) scenarioState(name string) string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if s, ok := ts.scenarios[name]; ok {
+		return s
 	}
+	return ScenarioStarted
 }
 
-func (tc *testcase) checkQueryParams(method, path string, want map[string]string, r *http.Request) {
-	if want != nil {
-		for wantK, wantV := range want {
-			if gotV := r.FormValue(wantK); gotV != wantV {
-				tc.fails = append(tc.fails,
-					fmt.Sprintf("%s %s query param %s doesn't match expectation \nGot: %s\nWant: %s",
-						method, path, wantK, gotV, wantV))
-			}
+func (ts *TestServer) setScenarioState(name, state string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.scenarios == nil {
+		ts.scenarios = make(map[string]string)
+	}
+	ts.scenarios[name] = state
+}
+
+// RecordFrom switches TestServer into recording mode: any request whose
+// path matches no registered expectation's Path pattern is proxied to
+// upstream instead of failing the test, and the observed request/response
+// pair is captured so RecordTo can write it out once the server stops.
+// A request to a registered path is never proxied: it is handled by that
+// path's expectations, and fails as an unexpected call once they are used up.
+func (ts *TestServer) RecordFrom(upstream string) *TestServer {
+	ts.recordUpstream = upstream
+	return ts
+}
+
+// RecordTo makes Stop write every fixture captured via RecordFrom to path,
+// as generated Go source - a series of EXPECT()...ts.Add(...) calls ready
+// to paste into a test. The same fixtures are also written as JSON to
+// path+".json", which is what Replay loads back.
+func (ts *TestServer) RecordTo(path string) *TestServer {
+	ts.recordToPath = path
+	return ts
+}
+
+// Replay loads fixtures previously captured with RecordFrom/RecordTo (from
+// the path+".json" file written alongside the generated source) and
+// registers a matching expectation for each one.
+func (ts *TestServer) Replay(path string) error {
+	data, err := os.ReadFile(path + ".json")
+	if err != nil {
+		return fmt.Errorf("testserver: replay %s: %w", path, err)
+	}
+
+	var fixtures []recordedFixture
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		return fmt.Errorf("testserver: replay %s: %w", path, err)
+	}
+
+	for _, f := range fixtures {
+		eb := EXPECT().Method(f.Method).Path(f.Path).RespWithStatus(f.RespStatus)
+		if f.ReqBody != "" {
+			eb.ReqBodyContains(f.ReqBody)
+		}
+		for k, v := range f.RespHeaders {
+			eb.RespWithHeader(k, v)
+		}
+		if f.RespBody != "" {
+			eb.RespWithBody([]byte(f.RespBody))
 		}
+		ts.Add(eb)
 	}
+	return nil
 }
 
-func (tc *testcase) checkHeaders(method, path string, want, got http.Header) {
-	if want != nil {
-		for wantK, wantVV := range want {
-			if gotVV, ok := got[wantK]; !ok {
-				tc.fails = append(tc.fails,
-					fmt.Sprintf("%s %s there is no %s request header", method, path, wantK))
-			} else {
-				for _, wantV := range wantVV {
-					if !contains(gotVV, wantV) {
-						tc.fails = append(tc.fails,
-							fmt.Sprintf("%s %s request header %q doesn't match expectation \nGot: %s\nWant: %s",
-								method, path, wantK, gotVV, wantV))
+// LoadOpenAPI reads an OpenAPI 3 document (JSON only) from path. For every
+// operation that has an operationId and a 2xx application/json response
+// with an example, it auto-registers a
+// default expectation returning that example; these are optional, so a
+// test that only exercises a handful of the spec's operations isn't forced
+// to call every one for Stop() to pass. It also keeps each operation's
+// request/response schemas around so an expectation bound to it via
+// ExpectationBuilder.MatchesOperation gets its request validated, and its
+// eventual response validated against the matching status code's schema,
+// reporting violations as ordinary match failures.
+func (ts *TestServer) LoadOpenAPI(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("testserver: load openapi spec %s: %w", path, err)
+	}
+
+	var spec openAPISpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return fmt.Errorf("testserver: parse openapi spec %s: %w", path, err)
+	}
+
+	ts.openapiOps = make(map[string]*openAPIOperationSpec)
+
+	for urlPattern, methods := range spec.Paths {
+		for method, op := range methods {
+			if op.OperationID == "" {
+				continue
+			}
+
+			opSpec := &openAPIOperationSpec{
+				method:          strings.ToUpper(method),
+				path:            urlPattern,
+				responseSchemas: make(map[int]*openAPISchema),
+			}
+			if op.RequestBody != nil {
+				if mt, ok := op.RequestBody.Content["application/json"]; ok {
+					opSpec.requestSchema = mt.Schema
+				}
+			}
+
+			exampleStatus := 0
+			var exampleBody []byte
+			for statusStr, resp := range op.Responses {
+				status, convErr := strconv.Atoi(statusStr)
+				if convErr != nil {
+					continue
+				}
+				mt, ok := resp.Content["application/json"]
+				if !ok {
+					continue
+				}
+				opSpec.responseSchemas[status] = mt.Schema
+				if status >= 200 && status < 300 && mt.Example != nil && (exampleStatus == 0 || status < exampleStatus) {
+					if body, err := json.Marshal(mt.Example); err == nil {
+						exampleStatus = status
+						exampleBody = body
 					}
 				}
 			}
+
+			ts.openapiOps[op.OperationID] = opSpec
+
+			if exampleStatus != 0 {
+				eb := EXPECT().Method(opSpec.method).Path(urlPattern).
+					MatchesOperation(op.OperationID).
+					RespWithStatus(exampleStatus).
+					RespWithBody(exampleBody)
+				// Auto-registered from the spec, not requested by the test:
+				// it must not force every documented operation to be called
+				// before Stop() will pass.
+				eb.optional = true
+				ts.Add(eb)
+			}
 		}
 	}
+	return nil
 }
 
-func contains(s []string, e string) bool {
-	for _, a := range s {
-		if a == e {
-			return true
+// recordAndProxy forwards an unmatched request to the RecordFrom upstream,
+// relays its response back to the client, and captures the pair for
+// RecordTo.
+func (ts *TestServer) recordAndProxy(w http.ResponseWriter, r *http.Request) {
+	reqBody, _ := io.ReadAll(r.Body)
+
+	proxyURL := strings.TrimRight(ts.recordUpstream, "/") + r.URL.RequestURI()
+	proxyReq, err := http.NewRequest(r.Method, proxyURL, bytes.NewReader(reqBody))
+	if err != nil {
+		ts.t.Errorf("testserver: build record proxy request %s %s: %v", r.Method, r.URL, err)
+		return
+	}
+	proxyReq.Header = r.Header.Clone()
+
+	resp, err := http.DefaultClient.Do(proxyReq)
+	if err != nil {
+		ts.t.Errorf("testserver: record proxy call %s %s: %v", r.Method, r.URL, err)
+		return
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(resp.Body)
+
+	respHeaders := make(map[string]string, len(resp.Header))
+	for k, vv := range resp.Header {
+		w.Header()[k] = vv
+		if len(vv) > 0 {
+			respHeaders[k] = vv[0]
 		}
 	}
-	return false
+	w.WriteHeader(resp.StatusCode)
+	w.Write(respBody)
+
+	ts.mu.Lock()
+	ts.recorded = append(ts.recorded, recordedFixture{
+		Method:      r.Method,
+		Path:        r.URL.Path,
+		ReqBody:     string(reqBody),
+		RespStatus:  resp.StatusCode,
+		RespBody:    string(respBody),
+		RespHeaders: respHeaders,
+	})
+	ts.mu.Unlock()
 }
 
-// New create new instance of TestServer
-func New(t *testing.T) *TestServer {
-	return &TestServer{
-		t:     t,
-		cases: make(map[string]*testcase),
+// writeRecordedFixtures persists fixtures captured via RecordFrom to
+// RecordTo's path, if both were configured and at least one call was
+// recorded.
+func (ts *TestServer) writeRecordedFixtures() {
+	if ts.recordToPath == "" || len(ts.recorded) == 0 {
+		return
+	}
+
+	var src strings.Builder
+	src.WriteString("// Code generated by testserver.TestServer.RecordFrom/RecordTo. DO NOT EDIT.\n\n")
+	for _, f := range ts.recorded {
+		fmt.Fprintf(&src, "ts.Add(EXPECT().Method(%q).Path(%q).\n", f.Method, f.Path)
+		if f.ReqBody != "" {
+			fmt.Fprintf(&src, "\tReqBodyContains(%q).\n", f.ReqBody)
+		}
+		fmt.Fprintf(&src, "\tRespWithStatus(%d)", f.RespStatus)
+		for k, v := range f.RespHeaders {
+			fmt.Fprintf(&src, ".\n\tRespWithHeader(%q, %q)", k, v)
+		}
+		if f.RespBody != "" {
+			fmt.Fprintf(&src, ".\n\tRespWithBody([]byte(%q))", f.RespBody)
+		}
+		src.WriteString(")\n\n")
+	}
+
+	if err := os.WriteFile(ts.recordToPath, []byte(src.String()), 0o644); err != nil {
+		ts.t.Errorf("testserver: write recorded fixtures to %s: %v", ts.recordToPath, err)
+		return
+	}
+
+	data, err := json.MarshalIndent(ts.recorded, "", "  ")
+	if err != nil {
+		ts.t.Errorf("testserver: marshal recorded fixtures: %v", err)
+		return
+	}
+	if err := os.WriteFile(ts.recordToPath+".json", data, 0o644); err != nil {
+		ts.t.Errorf("testserver: write recorded fixtures json to %s: %v", ts.recordToPath, err)
 	}
 }
 
@@ -299,38 +1126,156 @@ func New(t *testing.T) *TestServer {
 func (ts *TestServer) Add(eb *ExpectationBuilder) {
 	tc, ok := ts.cases[eb.urlPattern]
 	if !ok {
-		tc = &testcase{n: make(map[int]http.HandlerFunc)}
+		tc = &testcase{}
 		ts.cases[eb.urlPattern] = tc
 	}
 
+	if eb.operationID != "" {
+		if op, ok := ts.openapiOps[eb.operationID]; ok {
+			if op.requestSchema != nil {
+				eb.matchers = append(eb.matchers, schemaRequestMatcher{schema: op.requestSchema})
+			}
+			eb.opResponseSchemas = op.responseSchemas
+		}
+	}
+
 	for i := 0; i < eb.times; i++ {
-		tc.n[tc.wantedCalls] = func(w http.ResponseWriter, r *http.Request) {
+		slot := &expectationSlot{
+			hasScenario: eb.scenario != "",
+			scenario:    eb.scenario,
+			fromState:   eb.scenarioFrom,
+			toState:     eb.scenarioTo,
+			optional:    eb.optional,
+		}
+		slot.handler = func(w http.ResponseWriter, r *http.Request) {
 			_ = r.ParseForm()
 			reqBody, _ := io.ReadAll(r.Body)
 			m := r.Method
 			p := r.URL.Path
 
-			tc.checkMethod(p, eb.method, m)
-			tc.checkBody(m, p, eb.reqExactBody, reqBody)
-			tc.checkBodyContains(m, p, eb.reqContainBody, reqBody)
-			tc.checkPathParams(m, p, eb.reqPathParams, mux.Vars(r))
-			tc.checkQueryParams(m, p, eb.reqQueryParams, r)
-			tc.checkHeaders(m, p, eb.reqHeaders, r.Header)
+			for _, matcher := range eb.matchers {
+				tc.addFails(matcher.match(m, p, r, reqBody))
+			}
+
+			if eb.respDelay > 0 {
+				time.Sleep(eb.respDelay)
+			}
+
+			if eb.respHijackReset {
+				hj, ok := w.(http.Hijacker)
+				if !ok {
+					tc.addFail(fmt.Sprintf("%s %s RespWithHijackReset: response writer doesn't support hijacking", m, p))
+					return
+				}
+				conn, _, err := hj.Hijack()
+				if err != nil {
+					tc.addFail(fmt.Sprintf("%s %s RespWithHijackReset: %v", m, p, err))
+					return
+				}
+				conn.Close()
+				return
+			}
+
+			tctx := newTemplateContext(r, reqBody)
 
 			for k, vv := range eb.respHeaders {
 				for _, v := range vv {
 					w.Header().Add(k, v)
 				}
 			}
+			for _, ht := range eb.respHeaderTemplates {
+				rendered, err := renderTemplate(ht.tmpl, tctx)
+				if err != nil {
+					tc.addFail(fmt.Sprintf("%s %s response header template %q: %v", m, p, ht.key, err))
+					continue
+				}
+				w.Header().Add(ht.key, string(rendered))
+			}
 			w.Header()["Date"] = nil
-			w.WriteHeader(eb.respStatus)
-			w.Write(eb.respBody)
+
+			status := eb.respStatus
+			if eb.respStatusFunc != nil {
+				status = eb.respStatusFunc(r)
+			}
+			w.WriteHeader(status)
+
+			if len(eb.respChunks) > 0 {
+				flusher, _ := w.(http.Flusher)
+				for i, chunk := range eb.respChunks {
+					w.Write(chunk)
+					if flusher != nil {
+						flusher.Flush()
+					}
+					if eb.respChunkGap > 0 && i != len(eb.respChunks)-1 {
+						time.Sleep(eb.respChunkGap)
+					}
+				}
+			} else {
+				body := eb.respBody
+				if eb.respBodyTemplate != nil {
+					rendered, err := renderTemplate(eb.respBodyTemplate, tctx)
+					if err != nil {
+						tc.addFail(fmt.Sprintf("%s %s response body template: %v", m, p, err))
+					} else {
+						body = rendered
+					}
+				}
+				if schema, ok := eb.opResponseSchemas[status]; ok && schema != nil {
+					tc.addFails(validateResponseSchema(m, p, schema, body))
+				}
+				w.Write(body)
+			}
+
+			if eb.respCloseConn {
+				if flusher, ok := w.(http.Flusher); ok {
+					flusher.Flush()
+				}
+				if hj, ok := w.(http.Hijacker); ok {
+					if conn, _, err := hj.Hijack(); err == nil {
+						conn.Close()
+					}
+				}
+			}
 		}
 
-		tc.wantedCalls++
+		tc.slots = append(tc.slots, slot)
+		if !eb.optional {
+			tc.wantedCalls++
+		}
 	}
 }
 
+// pickSlot returns the first not-yet-used slot whose scenario preconditions
+// are currently satisfied, or nil if none is ready. Non-optional slots
+// (ones the test actually asked for) take priority over optional ones
+// (LoadOpenAPI's auto-registered defaults), so an explicit expectation for
+// an operation is never shadowed by its spec example.
+func (ts *TestServer) pickSlot(tc *testcase) *expectationSlot {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	var fallback *expectationSlot
+	for _, slot := range tc.slots {
+		if slot.used {
+			continue
+		}
+		if slot.hasScenario && ts.scenarioState(slot.scenario) != slot.fromState {
+			continue
+		}
+		if slot.optional {
+			if fallback == nil {
+				fallback = slot
+			}
+			continue
+		}
+		slot.used = true
+		return slot
+	}
+	if fallback != nil {
+		fallback.used = true
+	}
+	return fallback
+}
+
 // Start TestServer
 func (ts *TestServer) Start() {
 	router := mux.NewRouter()
@@ -339,13 +1284,32 @@ func (ts *TestServer) Start() {
 		url := url
 		c := c
 		router.HandleFunc(url, func(w http.ResponseWriter, r *http.Request) {
-			if handler, ok := c.n[c.actualCalls]; !ok {
-				c.fails = append(c.fails,
-					fmt.Sprintf("unexpected call %s %s\nWant calls: %d\nGot calls: %d\n",
-						r.Method, url, c.wantedCalls, c.actualCalls+1))
-			} else {
-				handler(w, r)
+			slot := ts.pickSlot(c)
+			if slot == nil {
+				c.addFail(fmt.Sprintf("unexpected call %s %s\nWant calls: %d\nGot calls: %d\n",
+					r.Method, url, c.wantedCalls, c.actualCalls+1))
+				return
+			}
+
+			bodyBytes, _ := io.ReadAll(r.Body)
+			r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+			ts.recordCall(RecordedRequest{
+				Method:  r.Method,
+				URL:     r.URL.String(),
+				Headers: r.Header.Clone(),
+				Body:    bodyBytes,
+				path:    r.URL.Path,
+			})
+
+			slot.handler(w, r)
+			if slot.hasScenario {
+				ts.setScenarioState(slot.scenario, slot.toState)
+			}
+
+			if !slot.optional {
+				c.mu.Lock()
 				c.actualCalls++
+				c.mu.Unlock()
 			}
 		})
 	}
@@ -353,6 +1317,9 @@ func (ts *TestServer) Start() {
 }
 
 func (ts *TestServer) notFound() http.Handler {
+	if ts.recordUpstream != "" {
+		return http.HandlerFunc(ts.recordAndProxy)
+	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ts.t.Errorf("unexpected call %s %s", r.Method, r.URL)
 	})
@@ -360,13 +1327,70 @@ func (ts *TestServer) notFound() http.Handler {
 
 // Stop TestServer and check expectations
 func (ts *TestServer) Stop() {
+	ts.writeRecordedFixtures()
 	for url, c := range ts.cases {
-		if c.wantedCalls != c.actualCalls {
-			ts.t.Errorf("there is %d calls %s, wanted: %d calls", c.actualCalls, url, c.wantedCalls)
+		c.mu.Lock()
+		actualCalls, fails := c.actualCalls, append([]string(nil), c.fails...)
+		c.mu.Unlock()
+
+		if c.wantedCalls != actualCalls {
+			ts.t.Errorf("there is %d calls %s, wanted: %d calls", actualCalls, url, c.wantedCalls)
 		}
-		for _, fail := range c.fails {
+		for _, fail := range fails {
 			ts.t.Error(fail)
 		}
 	}
 	ts.Close()
 }
+
+// recordCall appends rr to the call log, safe for concurrent callers.
+func (ts *TestServer) recordCall(rr RecordedRequest) {
+	ts.mu.Lock()
+	ts.calls = append(ts.calls, rr)
+	ts.mu.Unlock()
+}
+
+// CallsFor returns how many requests matching method and path have been
+// observed so far.
+func (ts *TestServer) CallsFor(method, path string) int {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	n := 0
+	for _, c := range ts.calls {
+		if c.Method == method && c.path == path {
+			n++
+		}
+	}
+	return n
+}
+
+// LastRequest returns a snapshot of the most recent request matching method
+// and path, or nil if there wasn't one yet.
+func (ts *TestServer) LastRequest(method, path string) *RecordedRequest {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for i := len(ts.calls) - 1; i >= 0; i-- {
+		if ts.calls[i].Method == method && ts.calls[i].path == path {
+			rr := ts.calls[i]
+			return &rr
+		}
+	}
+	return nil
+}
+
+// WaitForCalls blocks until method and path have been called at least n
+// times, polling until timeout elapses, and returns an error if it never
+// happens in time.
+func (ts *TestServer) WaitForCalls(method, path string, n int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		got := ts.CallsFor(method, path)
+		if got >= n {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("testserver: timed out waiting for %d calls to %s %s, got %d", n, method, path, got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}